@@ -19,9 +19,12 @@ package validation
 import (
 	"fmt"
 	"net"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/validation/field"
@@ -30,20 +33,34 @@ import (
 	"k8s.io/kops/upup/pkg/fi/cloudup/awsup"
 )
 
-func awsValidateCluster(c *kops.Cluster) field.ErrorList {
-	allErrs := field.ErrorList{}
+// wellKnownAPIListenerPort is the port the kOps API load balancer always
+// listens on for the Kubernetes API itself; extra listeners must not clash
+// with it.
+const wellKnownAPIListenerPort = 443
+
+func awsValidateCluster(c *kops.Cluster) *ValidationResults {
+	results := NewValidationResults()
 
 	if c.Spec.API != nil {
 		if c.Spec.API.LoadBalancer != nil {
-			allErrs = append(allErrs, awsValidateAdditionalSecurityGroups(field.NewPath("spec", "api", "loadBalancer", "additionalSecurityGroups"), c.Spec.API.LoadBalancer.AdditionalSecurityGroups)...)
-			allErrs = append(allErrs, awsValidateSSLPolicy(field.NewPath("spec", "api", "loadBalancer", "sslPolicy"), c.Spec.API.LoadBalancer)...)
-			allErrs = append(allErrs, awsValidateLoadBalancerSubnets(field.NewPath("spec", "api", "loadBalancer", "subnets"), c.Spec)...)
+			lbPath := field.NewPath("spec", "api", "loadBalancer")
+			results.AddErrors(awsValidateAdditionalSecurityGroups(lbPath.Child("additionalSecurityGroups"), c.Spec.API.LoadBalancer.AdditionalSecurityGroups)...)
+			results.AddErrors(awsValidateSSLPolicy(lbPath.Child("sslPolicy"), c.Spec.API.LoadBalancer)...)
+			results.AddErrors(awsValidateLoadBalancerSubnets(lbPath.Child("subnets"), c.Spec)...)
+			results.AddErrors(awsValidateExtraListeners(lbPath.Child("extraListeners"), c.Spec)...)
+
+			if c.Spec.API.LoadBalancer.Class == kops.LoadBalancerClassClassic {
+				results.AddWarnings(field.Invalid(lbPath.Child("class"), c.Spec.API.LoadBalancer.Class,
+					"Classic Load Balancers are deprecated on AWS; use Network (the kOps default) instead"))
+			}
 		}
 	}
 
-	allErrs = append(allErrs, awsValidateExternalCloudControllerManager(c.Spec)...)
+	results.AddErrors(awsValidateExternalCloudControllerManager(c.Spec)...)
 
-	return allErrs
+	results.AddErrors(validateValidationRules(field.NewPath("spec", "validationRules"), c.Spec.ValidationRules, c.Spec)...)
+
+	return results
 }
 
 func awsValidateExternalCloudControllerManager(c kops.ClusterSpec) (allErrs field.ErrorList) {
@@ -60,44 +77,125 @@ func awsValidateExternalCloudControllerManager(c kops.ClusterSpec) (allErrs fiel
 
 }
 
-func awsValidateInstanceGroup(ig *kops.InstanceGroup, cloud awsup.AWSCloud) field.ErrorList {
-	allErrs := field.ErrorList{}
+// ValidateInstanceGroup is the entry point production callers (kops
+// create/update/validate) use to validate an instance group; it threads
+// cluster through to the AWS-specific checks below so they can see
+// cluster-wide settings, such as IRSA, that ig.Spec alone does not carry.
+func ValidateInstanceGroup(cluster *kops.Cluster, ig *kops.InstanceGroup, cloud awsup.AWSCloud) field.ErrorList {
+	return awsValidateInstanceGroup(cluster, ig, cloud).Errors
+}
+
+func awsValidateInstanceGroup(cluster *kops.Cluster, ig *kops.InstanceGroup, cloud awsup.AWSCloud) *ValidationResults {
+	results := NewValidationResults()
 
-	allErrs = append(allErrs, awsValidateAdditionalSecurityGroups(field.NewPath("spec", "additionalSecurityGroups"), ig.Spec.AdditionalSecurityGroups)...)
+	results.AddErrors(awsValidateAdditionalSecurityGroups(field.NewPath("spec", "additionalSecurityGroups"), ig.Spec.AdditionalSecurityGroups)...)
 
-	allErrs = append(allErrs, awsValidateInstanceType(field.NewPath(ig.GetName(), "spec", "machineType"), ig.Spec.MachineType, cloud)...)
+	results.AddErrors(awsValidateInstanceType(field.NewPath(ig.GetName(), "spec", "machineType"), ig.Spec.MachineType, cluster.Spec.InstanceTypePolicy, cloud)...)
 
-	allErrs = append(allErrs, awsValidateSpotDurationInMinute(field.NewPath(ig.GetName(), "spec", "spotDurationInMinutes"), ig)...)
+	results.Append(awsValidateSpotDurationInMinute(field.NewPath(ig.GetName(), "spec", "spotDurationInMinutes"), ig))
 
-	allErrs = append(allErrs, awsValidateInstanceInterruptionBehavior(field.NewPath(ig.GetName(), "spec", "instanceInterruptionBehavior"), ig)...)
+	results.AddErrors(awsValidateInstanceInterruptionBehavior(field.NewPath(ig.GetName(), "spec", "instanceInterruptionBehavior"), ig)...)
 
 	if ig.Spec.MixedInstancesPolicy != nil {
-		allErrs = append(allErrs, awsValidateMixedInstancesPolicy(field.NewPath("spec", "mixedInstancesPolicy"), ig.Spec.MixedInstancesPolicy, ig, cloud)...)
+		results.AddErrors(awsValidateMixedInstancesPolicy(field.NewPath("spec", "mixedInstancesPolicy"), ig.Spec.MixedInstancesPolicy, ig, cluster.Spec.InstanceTypePolicy, cloud)...)
 	}
 
-	if ig.Spec.InstanceMetadata != nil {
-		allErrs = append(allErrs, awsValidateInstanceMetadata(field.NewPath("spec", "instanceMetadata"), ig.Spec.InstanceMetadata)...)
-	}
+	results.Append(awsValidateInstanceMetadata(field.NewPath("spec", "instanceMetadata"), cluster, ig))
 
-	return allErrs
+	results.AddErrors(validateValidationRules(field.NewPath(ig.GetName(), "spec", "validationRules"), ig.Spec.ValidationRules, ig.Spec)...)
+
+	return results
 }
 
-func awsValidateInstanceMetadata(fieldPath *field.Path, instanceMetadata *kops.InstanceMetadataOptions) field.ErrorList {
-	allErrs := field.ErrorList{}
+// awsValidateInstanceMetadata validates the effective IMDS configuration for
+// ig: its own spec.instanceMetadata, with any field left unset seeded from
+// spec.instanceMetadataDefaults on the cluster. Master instance groups and
+// clusters using IRSA are held to a stricter posture, since their node role
+// can mint credentials that must not be reachable over IMDSv1. An instance
+// group that leaves IMDS entirely unconfigured is treated the same as an
+// explicit httpTokens="optional": still an error for masters/IRSA, still a
+// warning otherwise, since AWS's own default permits IMDSv1.
+func awsValidateInstanceMetadata(fieldPath *field.Path, cluster *kops.Cluster, ig *kops.InstanceGroup) *ValidationResults {
+	results := NewValidationResults()
+
+	instanceMetadata := effectiveInstanceMetadata(cluster, ig)
+
+	var httpTokensField *string
+	var hopLimitField *int64
+	if instanceMetadata != nil {
+		httpTokensField = instanceMetadata.HTTPTokens
+		hopLimitField = instanceMetadata.HTTPPutResponseHopLimit
+
+		if httpTokensField != nil {
+			results.AddErrors(IsValidValue(fieldPath.Child("httpTokens"), httpTokensField, []string{"optional", "required"})...)
+		}
 
-	if instanceMetadata.HTTPTokens != nil {
-		allErrs = append(allErrs, IsValidValue(fieldPath.Child("httpTokens"), instanceMetadata.HTTPTokens, []string{"optional", "required"})...)
+		if hopLimitField != nil {
+			httpPutResponseHopLimit := fi.Int64Value(hopLimitField)
+			if httpPutResponseHopLimit < 1 || httpPutResponseHopLimit > 64 {
+				results.AddErrors(field.Invalid(fieldPath.Child("httpPutResponseHopLimit"), hopLimitField,
+					"HTTPPutResponseLimit must be a value between 1 and 64"))
+			}
+		}
 	}
 
-	if instanceMetadata.HTTPPutResponseHopLimit != nil {
-		httpPutResponseHopLimit := fi.Int64Value(instanceMetadata.HTTPPutResponseHopLimit)
-		if httpPutResponseHopLimit < 1 || httpPutResponseHopLimit > 64 {
-			allErrs = append(allErrs, field.Invalid(fieldPath.Child("httpPutResponseHopLimit"), instanceMetadata.HTTPPutResponseHopLimit,
-				"HTTPPutResponseLimit must be a value between 1 and 64"))
+	httpTokens := fi.StringValue(httpTokensField)
+	hopLimit := fi.Int64Value(hopLimitField)
+	usesAmazonVPC := cluster.Spec.Networking != nil && cluster.Spec.Networking.AmazonVPC != nil
+
+	if requiresHardenedIMDS(cluster, ig) {
+		if httpTokens != "required" {
+			results.AddErrors(field.Invalid(fieldPath.Child("httpTokens"), httpTokensField,
+				"httpTokens must be \"required\" for master instance groups and clusters using IRSA"))
+		}
+		if hopLimit > 2 {
+			results.AddErrors(field.Invalid(fieldPath.Child("httpPutResponseHopLimit"), hopLimitField,
+				"httpPutResponseHopLimit must be 2 or less for master instance groups and clusters using IRSA"))
 		}
+	} else if httpTokens != "required" {
+		results.AddWarnings(field.Invalid(fieldPath.Child("httpTokens"), httpTokensField,
+			"httpTokens is not \"required\"; IMDSv1 remains reachable, so \"required\" is recommended"))
 	}
 
-	return allErrs
+	if usesAmazonVPC && hopLimit == 1 {
+		results.AddErrors(field.Invalid(fieldPath.Child("httpPutResponseHopLimit"), hopLimitField,
+			"httpPutResponseHopLimit must be greater than 1 when spec.networking.amazonvpc is set, so pods reaching IMDS through the ENI have an extra hop"))
+	}
+
+	return results
+}
+
+// effectiveInstanceMetadata merges spec.instanceMetadataDefaults into ig's
+// own (possibly unset) InstanceMetadata, without mutating either object.
+func effectiveInstanceMetadata(cluster *kops.Cluster, ig *kops.InstanceGroup) *kops.InstanceMetadataOptions {
+	defaults := cluster.Spec.InstanceMetadataDefaults
+
+	if ig.Spec.InstanceMetadata == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return ig.Spec.InstanceMetadata
+	}
+
+	merged := *ig.Spec.InstanceMetadata
+	if merged.HTTPTokens == nil {
+		merged.HTTPTokens = defaults.HTTPTokens
+	}
+	if merged.HTTPPutResponseHopLimit == nil {
+		merged.HTTPPutResponseHopLimit = defaults.HTTPPutResponseHopLimit
+	}
+	return &merged
+}
+
+// requiresHardenedIMDS reports whether ig must run with HTTPTokens=required
+// and a hop limit of at most 2: control-plane nodes always mint cluster
+// credentials, and IRSA/OIDC lets any node mint pod-scoped AWS credentials,
+// so IMDSv1 is never an acceptable fallback in either case.
+func requiresHardenedIMDS(cluster *kops.Cluster, ig *kops.InstanceGroup) bool {
+	if ig.Spec.Role == kops.InstanceGroupRoleMaster {
+		return true
+	}
+	return cluster.Spec.IAM != nil && fi.BoolValue(cluster.Spec.IAM.UseServiceAccountExternalPermissions)
 }
 
 func awsValidateAdditionalSecurityGroups(fieldPath *field.Path, groups []string) field.ErrorList {
@@ -121,27 +219,163 @@ func awsValidateAdditionalSecurityGroups(fieldPath *field.Path, groups []string)
 	return allErrs
 }
 
-func awsValidateInstanceType(fieldPath *field.Path, instanceType string, cloud awsup.AWSCloud) field.ErrorList {
+func awsValidateInstanceType(fieldPath *field.Path, instanceType string, policy *kops.InstanceTypePolicy, cloud awsup.AWSCloud) field.ErrorList {
 	allErrs := field.ErrorList{}
-	if instanceType != "" && cloud != nil {
-		for _, typ := range strings.Split(instanceType, ",") {
-			if _, err := cloud.DescribeInstanceType(typ); err != nil {
-				allErrs = append(allErrs, field.Invalid(fieldPath, typ, "machine type specified is invalid"))
-			}
+	if instanceType == "" {
+		return allErrs
+	}
+
+	for _, typ := range strings.Split(instanceType, ",") {
+		allErrs = append(allErrs, awsValidateInstanceTypeAllowDenyList(fieldPath, typ, policy)...)
+
+		// The capability/vCPU/memory/GPU checks below need EC2's instance
+		// type metadata; without a live cloud client (e.g. offline
+		// validation) they're simply skipped, rather than also skipping
+		// the allow/deny list checks above, which need no AWS API call.
+		if cloud == nil {
+			continue
+		}
+
+		info, err := describeInstanceTypeCached(cloud, typ)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fieldPath, typ, "machine type specified is invalid"))
+			continue
 		}
+
+		allErrs = append(allErrs, awsValidateInstanceTypeCapabilities(fieldPath, typ, info, policy)...)
 	}
 
 	return allErrs
 }
 
-func awsValidateSpotDurationInMinute(fieldPath *field.Path, ig *kops.InstanceGroup) field.ErrorList {
+// instanceTypeCache memoizes cloud.DescribeInstanceType by region, so
+// validating a MixedInstancesPolicy or many instance groups that share
+// machine types across a cluster does not repeat the same AWS API call.
+var (
+	instanceTypeCacheMu sync.Mutex
+	instanceTypeCache   = map[string]*ec2.InstanceTypeInfo{}
+)
+
+func describeInstanceTypeCached(cloud awsup.AWSCloud, typ string) (*ec2.InstanceTypeInfo, error) {
+	key := cloud.Region() + "/" + typ
+
+	instanceTypeCacheMu.Lock()
+	info, ok := instanceTypeCache[key]
+	instanceTypeCacheMu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err := cloud.DescribeInstanceType(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceTypeCacheMu.Lock()
+	instanceTypeCache[key] = info
+	instanceTypeCacheMu.Unlock()
+
+	return info, nil
+}
+
+// awsValidateInstanceTypeAllowDenyList enforces an optional
+// spec.instanceTypePolicy allow/deny list against typ's name alone; unlike
+// awsValidateInstanceTypeCapabilities, this needs no AWS API call and so
+// always runs, even without a live cloud client.
+func awsValidateInstanceTypeAllowDenyList(fieldPath *field.Path, typ string, policy *kops.InstanceTypePolicy) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if policy == nil {
+		return allErrs
+	}
+
+	if len(policy.AllowList) > 0 && !instanceTypeMatchesAny(typ, policy.AllowList) {
+		allErrs = append(allErrs, field.Invalid(fieldPath, typ, "machine type is not in spec.instanceTypePolicy.allowList"))
+	}
+	if instanceTypeMatchesAny(typ, policy.DenyList) {
+		allErrs = append(allErrs, field.Invalid(fieldPath, typ, "machine type is in spec.instanceTypePolicy.denyList"))
+	}
+
+	return allErrs
+}
+
+// awsValidateInstanceTypeCapabilities enforces the parts of an optional
+// spec.instanceTypePolicy that need the instance type metadata EC2 reports
+// for typ: required capabilities, minimum vCPUs/memory, and GPU vendor.
+func awsValidateInstanceTypeCapabilities(fieldPath *field.Path, typ string, info *ec2.InstanceTypeInfo, policy *kops.InstanceTypePolicy) field.ErrorList {
 	allErrs := field.ErrorList{}
+	if policy == nil {
+		return allErrs
+	}
+
+	for _, capability := range policy.RequiredCapabilities {
+		if !instanceTypeHasCapability(info, capability) {
+			allErrs = append(allErrs, field.Invalid(fieldPath, typ, fmt.Sprintf("machine type does not support required capability %q", capability)))
+		}
+	}
+
+	if policy.MinVCPUs > 0 && info.VCpuInfo != nil && fi.Int64Value(info.VCpuInfo.DefaultVCpus) < int64(policy.MinVCPUs) {
+		allErrs = append(allErrs, field.Invalid(fieldPath, typ, fmt.Sprintf("machine type has fewer than the required %d vCPUs", policy.MinVCPUs)))
+	}
+
+	if policy.MinMemoryMB > 0 && info.MemoryInfo != nil && fi.Int64Value(info.MemoryInfo.SizeInMiB) < int64(policy.MinMemoryMB) {
+		allErrs = append(allErrs, field.Invalid(fieldPath, typ, fmt.Sprintf("machine type has less than the required %dMiB of memory", policy.MinMemoryMB)))
+	}
+
+	if policy.GPUVendor != "" && !instanceTypeHasGPUVendor(info, policy.GPUVendor) {
+		allErrs = append(allErrs, field.Invalid(fieldPath, typ, fmt.Sprintf("machine type has no %s GPU", policy.GPUVendor)))
+	}
+
+	return allErrs
+}
+
+func instanceTypeMatchesAny(typ string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceTypeHasCapability reports whether info satisfies one of the
+// capability names an add-on might require, e.g. "nitro" for Cilium's eBPF
+// datapath or "ena" for enhanced networking.
+func instanceTypeHasCapability(info *ec2.InstanceTypeInfo, capability string) bool {
+	switch capability {
+	case "nitro":
+		return fi.StringValue(info.Hypervisor) == ec2.InstanceTypeHypervisorNitro
+	case "ena":
+		return info.NetworkInfo != nil && fi.StringValue(info.NetworkInfo.EnaSupport) != ec2.EnaSupportUnsupported
+	case "nvme":
+		return info.InstanceStorageInfo != nil && fi.StringValue(info.InstanceStorageInfo.NvmeSupport) != ec2.EphemeralNvmeSupportUnsupported
+	default:
+		return false
+	}
+}
+
+func instanceTypeHasGPUVendor(info *ec2.InstanceTypeInfo, vendor string) bool {
+	if info.GpuInfo == nil {
+		return false
+	}
+	for _, gpu := range info.GpuInfo.Gpus {
+		if strings.EqualFold(fi.StringValue(gpu.Manufacturer), vendor) {
+			return true
+		}
+	}
+	return false
+}
+
+func awsValidateSpotDurationInMinute(fieldPath *field.Path, ig *kops.InstanceGroup) *ValidationResults {
+	results := NewValidationResults()
 	if ig.Spec.SpotDurationInMinutes != nil {
 		validSpotDurations := []string{"60", "120", "180", "240", "300", "360"}
 		spotDurationStr := strconv.FormatInt(*ig.Spec.SpotDurationInMinutes, 10)
-		allErrs = append(allErrs, IsValidValue(fieldPath, &spotDurationStr, validSpotDurations)...)
+		results.AddErrors(IsValidValue(fieldPath, &spotDurationStr, validSpotDurations)...)
+
+		results.AddWarnings(field.Invalid(fieldPath, *ig.Spec.SpotDurationInMinutes,
+			"spotDurationInMinutes is deprecated by AWS; fixed-duration Spot Instances are no longer offered"))
 	}
-	return allErrs
+	return results
 }
 
 func awsValidateInstanceInterruptionBehavior(fieldPath *field.Path, ig *kops.InstanceGroup) field.ErrorList {
@@ -154,12 +388,12 @@ func awsValidateInstanceInterruptionBehavior(fieldPath *field.Path, ig *kops.Ins
 }
 
 // awsValidateMixedInstancesPolicy is responsible for validating the user input of a mixed instance policy
-func awsValidateMixedInstancesPolicy(path *field.Path, spec *kops.MixedInstancesPolicySpec, ig *kops.InstanceGroup, cloud awsup.AWSCloud) field.ErrorList {
+func awsValidateMixedInstancesPolicy(path *field.Path, spec *kops.MixedInstancesPolicySpec, ig *kops.InstanceGroup, policy *kops.InstanceTypePolicy, cloud awsup.AWSCloud) field.ErrorList {
 	var errs field.ErrorList
 
 	// @step: check the instance types are valid
 	for i, x := range spec.Instances {
-		errs = append(errs, awsValidateInstanceType(path.Child("instances").Index(i), x, cloud)...)
+		errs = append(errs, awsValidateInstanceType(path.Child("instances").Index(i), x, policy, cloud)...)
 	}
 
 	if spec.OnDemandBase != nil {
@@ -200,19 +434,93 @@ func awsValidateSSLPolicy(fieldPath *field.Path, spec *kops.LoadBalancerAccessSp
 	return allErrs
 }
 
+// awsValidateExtraListeners validates the additional TCP/UDP/TLS listeners
+// an operator can attach to the NLB that fronts the API, alongside the
+// well-known Kubernetes API listener.
+func awsValidateExtraListeners(fieldPath *field.Path, spec kops.ClusterSpec) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	lbSpec := spec.API.LoadBalancer
+	if len(lbSpec.ExtraListeners) == 0 {
+		return allErrs
+	}
+
+	if lbSpec.Class != kops.LoadBalancerClassNetwork {
+		allErrs = append(allErrs, field.Forbidden(fieldPath, "extraListeners requires spec.api.loadBalancer.class to be Network"))
+	}
+
+	usedPorts := sets.NewInt32(wellKnownAPIListenerPort)
+	needsAmazonVPC := false
+
+	for i, listener := range lbSpec.ExtraListeners {
+		listenerPath := fieldPath.Index(i)
+
+		allErrs = append(allErrs, IsValidValue(listenerPath.Child("protocol"), &listener.Protocol, []string{"TCP", "UDP", "TLS"})...)
+
+		if listener.Port == 0 {
+			allErrs = append(allErrs, field.Required(listenerPath.Child("port"), "port is required"))
+		} else if usedPorts.Has(listener.Port) {
+			allErrs = append(allErrs, field.Duplicate(listenerPath.Child("port"), listener.Port))
+		} else {
+			usedPorts.Insert(listener.Port)
+		}
+
+		if listener.TargetPort == 0 {
+			allErrs = append(allErrs, field.Required(listenerPath.Child("targetPort"), "targetPort is required"))
+		}
+
+		if listener.Protocol == "TLS" {
+			if listener.SSLCertificate == "" {
+				allErrs = append(allErrs, field.Required(listenerPath.Child("sslCertificate"), "sslCertificate is required for TLS listeners"))
+			}
+		} else if listener.SSLCertificate != "" || listener.SSLPolicy != "" {
+			allErrs = append(allErrs, field.Forbidden(listenerPath, "sslCertificate and sslPolicy are only valid for TLS listeners"))
+		}
+
+		hasInstanceGroup := listener.InstanceGroup != ""
+		hasPodLabels := len(listener.PodLabelSelector) > 0
+		switch {
+		case hasInstanceGroup && hasPodLabels:
+			allErrs = append(allErrs, field.Forbidden(listenerPath, "instanceGroup and podLabelSelector are mutually exclusive"))
+		case !hasInstanceGroup && !hasPodLabels:
+			allErrs = append(allErrs, field.Required(listenerPath, "either instanceGroup or podLabelSelector must be set"))
+		case hasPodLabels:
+			needsAmazonVPC = true
+		}
+	}
+
+	if needsAmazonVPC && (spec.Networking == nil || spec.Networking.AmazonVPC == nil) {
+		allErrs = append(allErrs, field.Forbidden(fieldPath, "podLabelSelector targets require spec.networking.amazonvpc, so pod IPs are routable ENI targets"))
+	}
+
+	return allErrs
+}
+
+// awsValidateLoadBalancerSubnets validates spec.api.loadBalancer.subnets:
+// format and subnet-CIDR containment of any explicit privateIPv4Address,
+// and collisions either between lbSubnets entries themselves or against a
+// static privateIPv4Address already declared on one of spec.subnets (e.g.
+// for a NAT instance or bastion with a fixed address in that subnet). It
+// does not assign addresses itself — see PlanLoadBalancerSubnetIPs.
 func awsValidateLoadBalancerSubnets(fieldPath *field.Path, spec kops.ClusterSpec) field.ErrorList {
 	allErrs := field.ErrorList{}
 
 	lbSpec := spec.API.LoadBalancer
+	isInternalNLB := lbSpec.Class == kops.LoadBalancerClassNetwork && lbSpec.Type == kops.LoadBalancerTypeInternal
+
+	reservedIPs := clusterDeclaredStaticIPs(spec)
+	usedAllocationIDs := sets.NewString()
+
+	for i := range lbSpec.Subnets {
+		subnet := &lbSpec.Subnets[i]
 
-	for i, subnet := range lbSpec.Subnets {
 		var clusterSubnet *kops.ClusterSubnetSpec
 		if subnet.Name == "" {
 			allErrs = append(allErrs, field.Required(fieldPath.Index(i).Child("name"), "subnet name can't be empty"))
 		} else {
-			for _, cs := range spec.Subnets {
-				if subnet.Name == cs.Name {
-					clusterSubnet = &cs
+			for j := range spec.Subnets {
+				if subnet.Name == spec.Subnets[j].Name {
+					clusterSubnet = &spec.Subnets[j]
 					break
 				}
 			}
@@ -224,20 +532,22 @@ func awsValidateLoadBalancerSubnets(fieldPath *field.Path, spec kops.ClusterSpec
 		if subnet.PrivateIPv4Address != nil {
 			if *subnet.PrivateIPv4Address == "" {
 				allErrs = append(allErrs, field.Required(fieldPath.Index(i).Child("privateIPv4Address"), "privateIPv4Address can't be empty"))
-			}
-			ip := net.ParseIP(*subnet.PrivateIPv4Address)
-			if ip == nil || ip.To4() == nil {
+			} else if ip := net.ParseIP(*subnet.PrivateIPv4Address); ip == nil || ip.To4() == nil {
 				allErrs = append(allErrs, field.Invalid(fieldPath.Index(i).Child("privateIPv4Address"), subnet, "privateIPv4Address is not a valid IPv4 address"))
-			} else if clusterSubnet != nil {
-				_, ipNet, err := net.ParseCIDR(clusterSubnet.CIDR)
-				if err == nil { // we assume that the cidr is actually valid
-					if !ipNet.Contains(ip) {
-						allErrs = append(allErrs, field.Invalid(fieldPath.Index(i).Child("privateIPv4Address"), subnet, "privateIPv4Address is not part of the subnet CIDR"))
+			} else {
+				if clusterSubnet != nil {
+					if _, ipNet, err := net.ParseCIDR(clusterSubnet.CIDR); err == nil { // we assume that the cidr is actually valid
+						if !ipNet.Contains(ip) {
+							allErrs = append(allErrs, field.Invalid(fieldPath.Index(i).Child("privateIPv4Address"), subnet, "privateIPv4Address is not part of the subnet CIDR"))
+						}
 					}
 				}
-
+				if reservedIPs.Has(*subnet.PrivateIPv4Address) {
+					allErrs = append(allErrs, field.Duplicate(fieldPath.Index(i).Child("privateIPv4Address"), *subnet.PrivateIPv4Address))
+				}
+				reservedIPs.Insert(*subnet.PrivateIPv4Address)
 			}
-			if lbSpec.Class != kops.LoadBalancerClassNetwork || lbSpec.Type != kops.LoadBalancerTypeInternal {
+			if !isInternalNLB {
 				allErrs = append(allErrs, field.Forbidden(fieldPath.Index(i).Child("privateIPv4Address"), "privateIPv4Address only allowed for internal NLBs"))
 			}
 		}
@@ -245,6 +555,10 @@ func awsValidateLoadBalancerSubnets(fieldPath *field.Path, spec kops.ClusterSpec
 		if subnet.AllocationID != nil {
 			if *subnet.AllocationID == "" {
 				allErrs = append(allErrs, field.Required(fieldPath.Index(i).Child("allocationID"), "allocationID can't be empty"))
+			} else if usedAllocationIDs.Has(*subnet.AllocationID) {
+				allErrs = append(allErrs, field.Duplicate(fieldPath.Index(i).Child("allocationID"), *subnet.AllocationID))
+			} else {
+				usedAllocationIDs.Insert(*subnet.AllocationID)
 			}
 
 			if lbSpec.Class != kops.LoadBalancerClassNetwork || lbSpec.Type == kops.LoadBalancerTypeInternal {
@@ -255,3 +569,150 @@ func awsValidateLoadBalancerSubnets(fieldPath *field.Path, spec kops.ClusterSpec
 
 	return allErrs
 }
+
+// clusterDeclaredStaticIPs returns the privateIPv4Addresses already claimed
+// outside of spec.api.loadBalancer.subnets, e.g. a fixed address a NAT
+// instance or bastion declares on its spec.subnets entry, so the load
+// balancer subnet checks can treat them as reserved too.
+func clusterDeclaredStaticIPs(spec kops.ClusterSpec) sets.String {
+	reserved := sets.NewString()
+	for _, s := range spec.Subnets {
+		if s.PrivateIPv4Address != nil && *s.PrivateIPv4Address != "" {
+			reserved.Insert(*s.PrivateIPv4Address)
+		}
+	}
+	return reserved
+}
+
+// PlanLoadBalancerSubnetIPs deterministically assigns a privateIPv4Address
+// to every internal NLB subnet in spec.api.loadBalancer.subnets that omits
+// one, mutating spec in place so terraform/cloudformation targets emit a
+// stable value across runs. This is an explicit resolve step for apply-time
+// callers (e.g. "kops update cluster"); awsValidateLoadBalancerSubnets does
+// not call it, so read-only callers such as "kops validate cluster" never
+// mutate the cluster they were asked to inspect.
+func PlanLoadBalancerSubnetIPs(spec *kops.ClusterSpec, cloud awsup.AWSCloud) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if spec.API == nil || spec.API.LoadBalancer == nil {
+		return allErrs
+	}
+
+	lbSpec := spec.API.LoadBalancer
+	if lbSpec.Class != kops.LoadBalancerClassNetwork || lbSpec.Type != kops.LoadBalancerTypeInternal {
+		return allErrs
+	}
+
+	fieldPath := field.NewPath("spec", "api", "loadBalancer", "subnets")
+	reservedIPs := clusterDeclaredStaticIPs(*spec)
+	for _, s := range lbSpec.Subnets {
+		if s.PrivateIPv4Address != nil && *s.PrivateIPv4Address != "" {
+			reservedIPs.Insert(*s.PrivateIPv4Address)
+		}
+	}
+
+	for i := range lbSpec.Subnets {
+		subnet := &lbSpec.Subnets[i]
+		if subnet.PrivateIPv4Address != nil {
+			continue
+		}
+
+		var clusterSubnet *kops.ClusterSubnetSpec
+		for j := range spec.Subnets {
+			if subnet.Name == spec.Subnets[j].Name {
+				clusterSubnet = &spec.Subnets[j]
+				break
+			}
+		}
+		if clusterSubnet == nil {
+			continue // reported by awsValidateLoadBalancerSubnets
+		}
+
+		ip, err := planLoadBalancerSubnetIP(clusterSubnet, reservedIPs, cloud)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fieldPath.Index(i).Child("privateIPv4Address"), clusterSubnet.CIDR, err.Error()))
+			continue
+		}
+		subnet.PrivateIPv4Address = &ip
+		reservedIPs.Insert(ip)
+	}
+
+	return allErrs
+}
+
+// planLoadBalancerSubnetIP deterministically picks a free address from
+// clusterSubnet's CIDR: the lowest host address not in reserved (addresses
+// already claimed elsewhere in spec.api.loadBalancer.subnets or declared
+// as static addresses on spec.subnets), not already
+// attached to an ENI in the subnet, and not one of the five addresses AWS
+// itself reserves (the network address, the next three host addresses, and
+// the broadcast address).
+func planLoadBalancerSubnetIP(clusterSubnet *kops.ClusterSubnetSpec, reserved sets.String, cloud awsup.AWSCloud) (string, error) {
+	if cloud == nil {
+		return "", fmt.Errorf("no cloud provider available to allocate a privateIPv4Address")
+	}
+
+	ip, ipNet, err := net.ParseCIDR(clusterSubnet.CIDR)
+	if err != nil {
+		return "", fmt.Errorf("parsing subnet CIDR %q: %v", clusterSubnet.CIDR, err)
+	}
+
+	inUse, err := describeSubnetInUseIPs(clusterSubnet.ID, cloud)
+	if err != nil {
+		return "", err
+	}
+
+	network := ipToUint32(ip.Mask(ipNet.Mask))
+	ones, bits := ipNet.Mask.Size()
+	broadcast := network | (uint32(1)<<uint(bits-ones) - 1)
+
+	for addr := network + 4; addr < broadcast; addr++ {
+		candidate := uint32ToIP(addr).String()
+		if reserved.Has(candidate) || inUse.Has(candidate) {
+			continue
+		}
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("no free address available in subnet %q", clusterSubnet.CIDR)
+}
+
+// describeSubnetInUseIPs returns the private IPs already attached to ENIs in
+// subnetID, so the planner does not hand out an address AWS is already using.
+// A kops-managed subnet that has not been created yet has no ID and so no
+// ENIs to discover.
+func describeSubnetInUseIPs(subnetID string, cloud awsup.AWSCloud) (sets.String, error) {
+	inUse := sets.NewString()
+	if subnetID == "" {
+		return inUse, nil
+	}
+
+	result, err := cloud.EC2().DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("subnet-id"),
+				Values: aws.StringSlice([]string{subnetID}),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing network interfaces in subnet %q: %v", subnetID, err)
+	}
+
+	for _, eni := range result.NetworkInterfaces {
+		for _, addr := range eni.PrivateIpAddresses {
+			inUse.Insert(aws.StringValue(addr.PrivateIpAddress))
+		}
+	}
+
+	return inUse, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	return uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+}
+
+func uint32ToIP(v uint32) net.IP {
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package validation
 
 import (
+	"net"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"k8s.io/kops/upup/pkg/fi"
 	"k8s.io/kops/upup/pkg/fi/cloudup/awsup"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/kops/pkg/apis/kops"
 )
 
@@ -189,9 +194,9 @@ func TestValidateInstanceGroupSpec(t *testing.T) {
 			},
 			Spec: g.Input,
 		}
-		errs := awsValidateInstanceGroup(ig, cloud)
+		results := awsValidateInstanceGroup(&kops.Cluster{}, ig, cloud)
 
-		testErrors(t, g.Input, errs, g.ExpectedErrors)
+		testErrors(t, g.Input, results.Errors, g.ExpectedErrors)
 	}
 }
 
@@ -235,7 +240,7 @@ func TestInstanceMetadataOptions(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		errs := ValidateInstanceGroup(test.ig, cloud)
+		errs := ValidateInstanceGroup(&kops.Cluster{}, test.ig, cloud)
 		testErrors(t, test.ig.ObjectMeta.Name, errs, test.expected)
 	}
 }
@@ -419,7 +424,407 @@ func TestLoadBalancerSubnets(t *testing.T) {
 			})
 		}
 		cluster.Spec.API.LoadBalancer.Subnets = test.lbSubnets
-		errs := awsValidateCluster(&cluster)
-		testErrors(t, test, errs, test.expected)
+		results := awsValidateCluster(&cluster)
+		testErrors(t, test, results.Errors, test.expected)
+	}
+}
+
+func TestAWSValidateExtraListeners(t *testing.T) {
+	grid := []struct {
+		class     kops.LoadBalancerClass
+		networkng *kops.NetworkingSpec
+		listeners []kops.LoadBalancerListenerSpec
+		expected  []string
+	}{
+		{ // valid, instanceGroup target
+			class: kops.LoadBalancerClassNetwork,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TCP", Port: 2222, TargetPort: 22, InstanceGroup: "bastions"},
+			},
+		},
+		{ // valid, TLS with certificate, pod target via amazonvpc
+			class:     kops.LoadBalancerClassNetwork,
+			networkng: &kops.NetworkingSpec{AmazonVPC: &kops.AmazonVPCNetworkingSpec{}},
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TLS", Port: 9443, TargetPort: 9443, SSLCertificate: "arn:aws:acm:...", PodLabelSelector: map[string]string{"app": "webhook"}},
+			},
+		},
+		{ // wrong LB class
+			class: kops.LoadBalancerClassClassic,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TCP", Port: 2222, TargetPort: 22, InstanceGroup: "bastions"},
+			},
+			expected: []string{"Forbidden::spec.api.loadBalancer.extraListeners"},
+		},
+		{ // conflicts with the API listener port
+			class: kops.LoadBalancerClassNetwork,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TCP", Port: 443, TargetPort: 443, InstanceGroup: "bastions"},
+			},
+			expected: []string{"Duplicate value::spec.api.loadBalancer.extraListeners[0].port"},
+		},
+		{ // invalid protocol
+			class: kops.LoadBalancerClassNetwork,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "HTTP", Port: 2222, TargetPort: 22, InstanceGroup: "bastions"},
+			},
+			expected: []string{"Unsupported value::spec.api.loadBalancer.extraListeners[0].protocol"},
+		},
+		{ // sslCertificate without TLS
+			class: kops.LoadBalancerClassNetwork,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TCP", Port: 2222, TargetPort: 22, InstanceGroup: "bastions", SSLCertificate: "arn:aws:acm:..."},
+			},
+			expected: []string{"Forbidden::spec.api.loadBalancer.extraListeners[0]"},
+		},
+		{ // neither instanceGroup nor podLabelSelector
+			class: kops.LoadBalancerClassNetwork,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TCP", Port: 2222, TargetPort: 22},
+			},
+			expected: []string{"Required value::spec.api.loadBalancer.extraListeners[0]"},
+		},
+		{ // podLabelSelector without amazonvpc
+			class: kops.LoadBalancerClassNetwork,
+			listeners: []kops.LoadBalancerListenerSpec{
+				{Protocol: "TCP", Port: 2222, TargetPort: 22, PodLabelSelector: map[string]string{"app": "webhook"}},
+			},
+			expected: []string{"Forbidden::spec.api.loadBalancer.extraListeners"},
+		},
+	}
+
+	for _, g := range grid {
+		cluster := kops.Cluster{
+			Spec: kops.ClusterSpec{
+				API: &kops.AccessSpec{
+					LoadBalancer: &kops.LoadBalancerAccessSpec{
+						Class:          g.class,
+						Type:           kops.LoadBalancerTypeInternal,
+						ExtraListeners: g.listeners,
+					},
+				},
+				Networking: g.networkng,
+			},
+		}
+		results := awsValidateCluster(&cluster)
+		testErrors(t, g, results.Errors, g.expected)
+	}
+}
+
+func TestAWSValidateWarnings(t *testing.T) {
+	grid := []struct {
+		Input            kops.InstanceGroupSpec
+		ExpectedWarnings []string
+	}{
+		{
+			Input: kops.InstanceGroupSpec{
+				SpotDurationInMinutes: fi.Int64(120),
+			},
+			ExpectedWarnings: []string{
+				"Invalid value::test-nodes.spec.spotDurationInMinutes",
+				"Invalid value::spec.instanceMetadata.httpTokens",
+			},
+		},
+		{
+			Input: kops.InstanceGroupSpec{
+				InstanceMetadata: &kops.InstanceMetadataOptions{
+					HTTPTokens: fi.String("optional"),
+				},
+			},
+			ExpectedWarnings: []string{
+				"Invalid value::spec.instanceMetadata.httpTokens",
+			},
+		},
+		{
+			Input: kops.InstanceGroupSpec{
+				InstanceMetadata: &kops.InstanceMetadataOptions{
+					HTTPTokens: fi.String("required"),
+				},
+			},
+			ExpectedWarnings: []string{},
+		},
+	}
+	cloud := awsup.BuildMockAWSCloud("us-east-1", "abc")
+	for _, g := range grid {
+		ig := &kops.InstanceGroup{
+			ObjectMeta: v1.ObjectMeta{
+				Name: "test-nodes",
+			},
+			Spec: g.Input,
+		}
+		results := awsValidateInstanceGroup(&kops.Cluster{}, ig, cloud)
+
+		testErrors(t, g.Input, results.Warnings, g.ExpectedWarnings)
+	}
+}
+
+func TestAWSValidateClassicELBWarning(t *testing.T) {
+	cluster := kops.Cluster{
+		Spec: kops.ClusterSpec{
+			API: &kops.AccessSpec{
+				LoadBalancer: &kops.LoadBalancerAccessSpec{
+					Class: kops.LoadBalancerClassClassic,
+					Type:  kops.LoadBalancerTypeInternal,
+				},
+			},
+		},
+	}
+
+	results := awsValidateCluster(&cluster)
+	testErrors(t, cluster, results.Warnings, []string{"Invalid value::spec.api.loadBalancer.class"})
+}
+
+func TestAWSValidateInstanceMetadataPosture(t *testing.T) {
+	grid := []struct {
+		cluster  kops.Cluster
+		role     kops.InstanceGroupRole
+		metadata *kops.InstanceMetadataOptions
+		expected []string
+	}{
+		{ // master on required with hop limit 1, ok
+			role: kops.InstanceGroupRoleMaster,
+			metadata: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("required"),
+				HTTPPutResponseHopLimit: fi.Int64(1),
+			},
+		},
+		{ // master on optional is an error, not just a warning
+			role: kops.InstanceGroupRoleMaster,
+			metadata: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("optional"),
+				HTTPPutResponseHopLimit: fi.Int64(1),
+			},
+			expected: []string{"Invalid value::spec.instanceMetadata.httpTokens"},
+		},
+		{ // master hop limit above 2 is an error
+			role: kops.InstanceGroupRoleMaster,
+			metadata: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("required"),
+				HTTPPutResponseHopLimit: fi.Int64(3),
+			},
+			expected: []string{"Invalid value::spec.instanceMetadata.httpPutResponseHopLimit"},
+		},
+		{ // IRSA cluster also requires "required", even for a node group
+			cluster: kops.Cluster{
+				Spec: kops.ClusterSpec{
+					IAM: &kops.IAMSpec{UseServiceAccountExternalPermissions: fi.Bool(true)},
+				},
+			},
+			role: kops.InstanceGroupRoleNode,
+			metadata: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("optional"),
+				HTTPPutResponseHopLimit: fi.Int64(1),
+			},
+			expected: []string{"Invalid value::spec.instanceMetadata.httpTokens"},
+		},
+		{ // plain node on optional is only a warning
+			role: kops.InstanceGroupRoleNode,
+			metadata: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("optional"),
+				HTTPPutResponseHopLimit: fi.Int64(1),
+			},
+		},
+		{ // amazonvpc needs a hop limit greater than 1 so pods can reach IMDS via the ENI
+			cluster: kops.Cluster{
+				Spec: kops.ClusterSpec{
+					Networking: &kops.NetworkingSpec{AmazonVPC: &kops.AmazonVPCNetworkingSpec{}},
+				},
+			},
+			role: kops.InstanceGroupRoleNode,
+			metadata: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("required"),
+				HTTPPutResponseHopLimit: fi.Int64(1),
+			},
+			expected: []string{"Invalid value::spec.instanceMetadata.httpPutResponseHopLimit"},
+		},
 	}
+
+	for _, g := range grid {
+		ig := &kops.InstanceGroup{
+			Spec: kops.InstanceGroupSpec{
+				Role:             g.role,
+				InstanceMetadata: g.metadata,
+			},
+		}
+		results := awsValidateInstanceMetadata(field.NewPath("spec", "instanceMetadata"), &g.cluster, ig)
+		testErrors(t, g, results.Errors, g.expected)
+	}
+}
+
+func TestAWSInstanceMetadataDefaults(t *testing.T) {
+	cluster := kops.Cluster{
+		Spec: kops.ClusterSpec{
+			InstanceMetadataDefaults: &kops.InstanceMetadataOptions{
+				HTTPTokens:              fi.String("required"),
+				HTTPPutResponseHopLimit: fi.Int64(1),
+			},
+		},
+	}
+
+	ig := &kops.InstanceGroup{
+		Spec: kops.InstanceGroupSpec{
+			Role: kops.InstanceGroupRoleNode,
+		},
+	}
+
+	results := awsValidateInstanceMetadata(field.NewPath("spec", "instanceMetadata"), &cluster, ig)
+	testErrors(t, ig, results.Errors, []string{})
+
+	ig.Spec.InstanceMetadata = &kops.InstanceMetadataOptions{HTTPTokens: fi.String("optional")}
+	results = awsValidateInstanceMetadata(field.NewPath("spec", "instanceMetadata"), &cluster, ig)
+	testErrors(t, ig, results.Warnings, []string{"Invalid value::spec.instanceMetadata.httpTokens"})
+}
+
+func TestAWSValidateInstanceTypePolicy(t *testing.T) {
+	grid := []struct {
+		machineType string
+		policy      *kops.InstanceTypePolicy
+		expected    []string
+	}{
+		{
+			machineType: "m5.large",
+			policy:      &kops.InstanceTypePolicy{AllowList: []string{"m5.*", "c5.*"}},
+		},
+		{
+			machineType: "t2.micro",
+			policy:      &kops.InstanceTypePolicy{AllowList: []string{"m5.*", "c5.*"}},
+			expected:    []string{"Invalid value::test-nodes.spec.machineType"},
+		},
+		{
+			machineType: "t2.micro",
+			policy:      &kops.InstanceTypePolicy{DenyList: []string{"t2.*"}},
+			expected:    []string{"Invalid value::test-nodes.spec.machineType"},
+		},
+	}
+
+	cloud := awsup.BuildMockAWSCloud("us-east-1", "abc")
+	for _, g := range grid {
+		ig := &kops.InstanceGroup{
+			ObjectMeta: v1.ObjectMeta{Name: "test-nodes"},
+			Spec:       kops.InstanceGroupSpec{MachineType: g.machineType},
+		}
+		cluster := &kops.Cluster{
+			Spec: kops.ClusterSpec{InstanceTypePolicy: g.policy},
+		}
+		results := awsValidateInstanceGroup(cluster, ig, cloud)
+		testErrors(t, g, results.Errors, g.expected)
+	}
+}
+
+func TestPlanLoadBalancerSubnetIP(t *testing.T) {
+	cloud := awsup.BuildMockAWSCloud("us-east-1", "abc")
+	clusterSubnet := &kops.ClusterSubnetSpec{Name: "a", CIDR: "10.0.0.0/24"}
+
+	first, err := planLoadBalancerSubnetIP(clusterSubnet, sets.NewString(), cloud)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != "10.0.0.4" {
+		t.Fatalf("expected the first free address after the AWS-reserved range, got %q", first)
+	}
+
+	second, err := planLoadBalancerSubnetIP(clusterSubnet, sets.NewString(first), cloud)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second == first {
+		t.Fatalf("expected a different address once %q is reserved", first)
+	}
+
+	_, tinyNet, _ := net.ParseCIDR("10.0.0.0/30")
+	_, err = planLoadBalancerSubnetIP(&kops.ClusterSubnetSpec{Name: "tiny", CIDR: tinyNet.String()}, sets.NewString(), cloud)
+	if err == nil {
+		t.Fatalf("expected an error when the subnet has no usable host addresses")
+	}
+}
+
+func TestPlanLoadBalancerSubnetIPSkipsInUseAddresses(t *testing.T) {
+	cloud := awsup.BuildMockAWSCloud("us-east-1", "abc")
+
+	if _, err := cloud.EC2().CreateNetworkInterface(&ec2.CreateNetworkInterfaceInput{
+		SubnetId:         aws.String("subnet-1"),
+		PrivateIpAddress: aws.String("10.0.0.4"),
+	}); err != nil {
+		t.Fatalf("seeding mock ENI: %v", err)
+	}
+
+	clusterSubnet := &kops.ClusterSubnetSpec{Name: "a", ID: "subnet-1", CIDR: "10.0.0.0/24"}
+	ip, err := planLoadBalancerSubnetIP(clusterSubnet, sets.NewString(), cloud)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip == "10.0.0.4" {
+		t.Fatalf("expected the planner to skip 10.0.0.4, already attached to a mocked ENI in the subnet, got %q", ip)
+	}
+}
+
+func TestPlanLoadBalancerSubnetIPs(t *testing.T) {
+	cloud := awsup.BuildMockAWSCloud("us-east-1", "abc")
+
+	spec := &kops.ClusterSpec{
+		API: &kops.AccessSpec{
+			LoadBalancer: &kops.LoadBalancerAccessSpec{
+				Class: kops.LoadBalancerClassNetwork,
+				Type:  kops.LoadBalancerTypeInternal,
+				Subnets: []kops.LoadBalancerSubnetSpec{
+					{Name: "a"},
+				},
+			},
+		},
+		Subnets: []kops.ClusterSubnetSpec{
+			{Name: "a", CIDR: "10.0.0.0/24"},
+		},
+	}
+
+	if errs := PlanLoadBalancerSubnetIPs(spec, cloud); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if spec.API.LoadBalancer.Subnets[0].PrivateIPv4Address == nil {
+		t.Fatalf("expected PlanLoadBalancerSubnetIPs to assign a privateIPv4Address")
+	}
+
+	// awsValidateLoadBalancerSubnets must never perform this mutation
+	// itself; it is read-only.
+	unresolved := kops.ClusterSpec{
+		API: &kops.AccessSpec{
+			LoadBalancer: &kops.LoadBalancerAccessSpec{
+				Class: kops.LoadBalancerClassNetwork,
+				Type:  kops.LoadBalancerTypeInternal,
+				Subnets: []kops.LoadBalancerSubnetSpec{
+					{Name: "a"},
+				},
+			},
+		},
+		Subnets: []kops.ClusterSubnetSpec{
+			{Name: "a", CIDR: "10.0.0.0/24"},
+		},
+	}
+	if errs := awsValidateLoadBalancerSubnets(field.NewPath("spec", "api", "loadBalancer", "subnets"), unresolved); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if unresolved.API.LoadBalancer.Subnets[0].PrivateIPv4Address != nil {
+		t.Fatalf("awsValidateLoadBalancerSubnets must not mutate the cluster spec it validates")
+	}
+}
+
+func TestClusterDeclaredStaticIPCollision(t *testing.T) {
+	cluster := kops.Cluster{
+		Spec: kops.ClusterSpec{
+			API: &kops.AccessSpec{
+				LoadBalancer: &kops.LoadBalancerAccessSpec{
+					Class: kops.LoadBalancerClassNetwork,
+					Type:  kops.LoadBalancerTypeInternal,
+					Subnets: []kops.LoadBalancerSubnetSpec{
+						{Name: "a", PrivateIPv4Address: fi.String("10.0.0.10")},
+					},
+				},
+			},
+			Subnets: []kops.ClusterSubnetSpec{
+				{Name: "a", CIDR: "10.0.0.0/24", PrivateIPv4Address: fi.String("10.0.0.10")},
+			},
+		},
+	}
+
+	results := awsValidateCluster(&cluster)
+	testErrors(t, cluster, results.Errors, []string{"Duplicate value::spec.api.loadBalancer.subnets[0].privateIPv4Address"})
 }
@@ -0,0 +1,152 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kops/pkg/apis/kops"
+)
+
+// celProgramCache memoizes compiled CEL programs by a hash of their source
+// expression, so a rule shared across many instance groups in the same
+// cluster is only compiled once per validation run.
+var (
+	celProgramCacheMu sync.Mutex
+	celProgramCache   = map[string]cel.Program{}
+)
+
+// validateValidationRules evaluates the operator-supplied spec.validationRules
+// against self (a ClusterSpec or InstanceGroupSpec), appending a field.Invalid
+// for every rule whose CEL expression does not evaluate to true.
+func validateValidationRules(fieldPath *field.Path, rules []kops.ValidationRule, self interface{}) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if len(rules) == 0 {
+		return allErrs
+	}
+
+	// cel-go's default type adapter can only convert maps, slices and
+	// primitives to a ref.Val, not an arbitrary Go struct, so self is
+	// round-tripped through its JSON representation before it is handed
+	// to the CEL program. This also means rule expressions address
+	// fields by their JSON name (e.g. self.machineType), matching how
+	// operators already see the spec everywhere else.
+	celSelf, err := toCELValue(self)
+	if err != nil {
+		allErrs = append(allErrs, field.InternalError(fieldPath, fmt.Errorf("converting %T for validation rules: %v", self, err)))
+		return allErrs
+	}
+
+	for i, rule := range rules {
+		rulePath := fieldPath.Index(i)
+
+		program, err := compiledCELProgram(rule.Expression)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(rulePath.Child("expression"), rule.Expression, fmt.Sprintf("could not compile validation rule %q: %v", rule.Name, err)))
+			continue
+		}
+
+		out, _, err := program.Eval(map[string]interface{}{"self": celSelf})
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(rulePath.Child("expression"), rule.Expression, fmt.Sprintf("could not evaluate validation rule %q: %v", rule.Name, err)))
+			continue
+		}
+
+		valid, ok := out.Value().(bool)
+		if !ok {
+			allErrs = append(allErrs, field.Invalid(rulePath.Child("expression"), rule.Expression, fmt.Sprintf("validation rule %q did not evaluate to a boolean", rule.Name)))
+			continue
+		}
+		if valid {
+			continue
+		}
+
+		message := rule.MessageExpression
+		if message == "" {
+			message = fmt.Sprintf("failed validation rule %q", rule.Name)
+		}
+
+		errPath := rulePath
+		if rule.FieldPath != "" {
+			errPath = field.NewPath(rule.FieldPath)
+		}
+		allErrs = append(allErrs, field.Invalid(errPath, rule.Name, message))
+	}
+
+	return allErrs
+}
+
+// toCELValue converts self to the map/slice/primitive representation CEL's
+// default type adapter knows how to turn into a ref.Val.
+func toCELValue(self interface{}) (interface{}, error) {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// compiledCELProgram compiles expression against an environment that exposes
+// the object under validation as the "self" variable, caching the result.
+func compiledCELProgram(expression string) (cel.Program, error) {
+	key := celCacheKey(expression)
+
+	celProgramCacheMu.Lock()
+	program, ok := celProgramCache[key]
+	celProgramCacheMu.Unlock()
+	if ok {
+		return program, nil
+	}
+
+	env, err := cel.NewEnv(cel.Variable("self", cel.DynType))
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	program, err = env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	celProgramCacheMu.Lock()
+	celProgramCache[key] = program
+	celProgramCacheMu.Unlock()
+
+	return program, nil
+}
+
+func celCacheKey(expression string) string {
+	sum := sha256.Sum256([]byte(expression))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kops/pkg/apis/kops"
+)
+
+func TestValidateValidationRules(t *testing.T) {
+	grid := []struct {
+		rules    []kops.ValidationRule
+		self     interface{}
+		expected []string
+	}{
+		{
+			rules: []kops.ValidationRule{
+				{Name: "no-t2", Expression: `!self.machineType.startsWith("t2.")`},
+			},
+			self:     kops.InstanceGroupSpec{MachineType: "m5.large"},
+			expected: []string{},
+		},
+		{
+			rules: []kops.ValidationRule{
+				{Name: "no-t2", Expression: `!self.machineType.startsWith("t2.")`},
+			},
+			self:     kops.InstanceGroupSpec{MachineType: "t2.micro"},
+			expected: []string{"Invalid value::spec.validationRules[0]"},
+		},
+		{
+			rules: []kops.ValidationRule{
+				{Name: "bad-expression", Expression: `self.(`},
+			},
+			self:     kops.InstanceGroupSpec{},
+			expected: []string{"Invalid value::spec.validationRules[0].expression"},
+		},
+	}
+
+	for _, g := range grid {
+		errs := validateValidationRules(field.NewPath("spec", "validationRules"), g.rules, g.self)
+		testErrors(t, g, errs, g.expected)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import "k8s.io/apimachinery/pkg/util/validation/field"
+
+// ValidationResults holds the outcome of validating a cluster or instance
+// group: fatal Errors that must block the operation, and non-fatal Warnings
+// that describe discouraged configuration the caller should surface but not
+// abort on.
+type ValidationResults struct {
+	Warnings field.ErrorList
+	Errors   field.ErrorList
+}
+
+// NewValidationResults returns an empty ValidationResults.
+func NewValidationResults() *ValidationResults {
+	return &ValidationResults{}
+}
+
+// Append merges the warnings and errors of other into r.
+func (r *ValidationResults) Append(other *ValidationResults) {
+	if other == nil {
+		return
+	}
+	r.Warnings = append(r.Warnings, other.Warnings...)
+	r.Errors = append(r.Errors, other.Errors...)
+}
+
+// AddWarnings appends to the warning list.
+func (r *ValidationResults) AddWarnings(warnings ...*field.Error) {
+	r.Warnings = append(r.Warnings, warnings...)
+}
+
+// AddErrors appends to the error list.
+func (r *ValidationResults) AddErrors(errs ...*field.Error) {
+	r.Errors = append(r.Errors, errs...)
+}